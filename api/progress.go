@@ -0,0 +1,95 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.skroutz.gr/skroutz/downloader/job"
+	"golang.skroutz.gr/skroutz/downloader/processor"
+	"golang.skroutz.gr/skroutz/downloader/storage"
+)
+
+// pollInterval bounds how long ServeProgress can stay open after a job
+// reaches a terminal state without a progress message arriving to trigger
+// the check (e.g. the download failed before the first publish).
+const pollInterval = 2 * time.Second
+
+// Server exposes the downloader's HTTP API, including progress streaming
+// for in-flight jobs.
+type Server struct {
+	Storage *storage.Storage
+}
+
+// ServeProgress handles GET /jobs/{id}/progress, upgrading the connection
+// to Server-Sent-Events and streaming processor.Progress snapshots for the
+// given job until it reaches a terminal download state.
+func (s *Server) ServeProgress(w http.ResponseWriter, r *http.Request, jobID string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Flush the headers immediately instead of waiting for the first
+	// event: otherwise a client sees no response at all, and not just a
+	// delayed one, until the job's first progress message arrives.
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	sub := s.Storage.Redis.Subscribe(processor.ProgressChannel(jobID))
+	// Closing sub unblocks the receive loop below as soon as this
+	// handler returns, regardless of why it returned.
+	defer sub.Close()
+
+	ctx := r.Context()
+
+	msgs := make(chan string)
+	go func() {
+		for {
+			msg, err := sub.ReceiveMessage()
+			if err != nil {
+				return
+			}
+			select {
+			case msgs <- msg.Payload:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case payload := <-msgs:
+			fmt.Fprintf(w, "data: %s\n\n", payload)
+			flusher.Flush()
+			if s.jobIsTerminal(jobID) {
+				return
+			}
+		case <-ticker.C:
+			if s.jobIsTerminal(jobID) {
+				return
+			}
+		}
+	}
+}
+
+// jobIsTerminal reports whether jobID has reached a terminal download
+// state, treating a lookup error as non-terminal so a transient Redis
+// error doesn't cut the stream short.
+func (s *Server) jobIsTerminal(jobID string) bool {
+	j, err := s.Storage.GetJob(jobID)
+	if err != nil {
+		return false
+	}
+	return j.DownloadState == job.StateSuccess || j.DownloadState == job.StateFailed
+}
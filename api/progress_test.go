@@ -0,0 +1,98 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"gopkg.in/redis.v6"
+
+	"golang.skroutz.gr/skroutz/downloader/job"
+	"golang.skroutz.gr/skroutz/downloader/processor"
+	"golang.skroutz.gr/skroutz/downloader/storage"
+)
+
+func newTestStorage(t *testing.T) *storage.Storage {
+	t.Helper()
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("could not start miniredis: %v", err)
+	}
+	t.Cleanup(mr.Close)
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	return storage.New(client)
+}
+
+func TestServeProgressStreamsAndTerminatesOnTerminalState(t *testing.T) {
+	s := newTestStorage(t)
+	srv := &Server{Storage: s}
+
+	j := &job.Job{ID: "job-1", DownloadState: job.StateInProgress}
+	if err := s.SaveJob(j); err != nil {
+		t.Fatalf("SaveJob: %v", err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.ServeProgress(w, r, j.ID)
+	}))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q, want text/event-stream", ct)
+	}
+
+	bodyCh := make(chan []byte, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		bodyCh <- b
+	}()
+
+	// Give ServeProgress's Subscribe a moment to register with Redis
+	// before publishing, mirroring the synchronization xfer's coalescing
+	// test already relies on.
+	time.Sleep(50 * time.Millisecond)
+	s.Redis.Publish(processor.ProgressChannel(j.ID), `{"bytes_done":1}`)
+
+	time.Sleep(50 * time.Millisecond)
+	j.DownloadState = job.StateSuccess
+	if err := s.SaveJob(j); err != nil {
+		t.Fatalf("SaveJob: %v", err)
+	}
+	// ServeProgress only re-checks terminal state on the next message or
+	// poll tick, so nudge it with a second message instead of waiting out
+	// pollInterval.
+	s.Redis.Publish(processor.ProgressChannel(j.ID), `{"bytes_done":2}`)
+
+	select {
+	case err := <-errCh:
+		t.Fatalf("reading response body: %v", err)
+	case body := <-bodyCh:
+		got := string(body)
+		if want := "data: {\"bytes_done\":1}\n\n"; !strings.Contains(got, want) {
+			t.Errorf("response body = %q, want it to contain %q", got, want)
+		}
+		if want := "data: {\"bytes_done\":2}\n\n"; !strings.Contains(got, want) {
+			t.Errorf("response body = %q, want it to contain %q", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ServeProgress did not terminate once the job reached a terminal state")
+	}
+}
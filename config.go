@@ -13,5 +13,21 @@ type Config struct {
 
 	Notifier struct {
 		Concurrency int `json:"concurrency"`
+
+		// RetryBase, RetryCap and RetryJitter are in seconds and tune
+		// the backoff applied between callback attempts.
+		RetryBase   int `json:"retry_base"`
+		RetryCap    int `json:"retry_cap"`
+		RetryJitter int `json:"retry_jitter"`
+
+		MaxCallbackRetries int `json:"max_callback_retries"`
+
+		BreakerThreshold int `json:"breaker_threshold"`
+		BreakerCooldown  int `json:"breaker_cooldown"`
+
+		// LeaseTTL and ReaperInterval are in seconds and tune the
+		// rogue-callback reaper.
+		LeaseTTL       int `json:"lease_ttl"`
+		ReaperInterval int `json:"reaper_interval"`
 	} `json:"notifier"`
 }
@@ -0,0 +1,117 @@
+// Package job provides the Job entity that flows through the downloader
+// pipeline, from submission to download and callback notification.
+package job
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// State represents the download or callback state of a Job.
+type State string
+
+// Valid states for a Job's DownloadState and CallbackState.
+const (
+	StatePending    State = "Pending"
+	StateInProgress State = "In Progress"
+	StateSuccess    State = "Success"
+	StateFailed     State = "Failed"
+)
+
+// Job represents a user request for downloading a resource.
+//
+// It is submitted by the API, persisted in Redis and consumed by the
+// processor and the notifier.
+type Job struct {
+	ID     string `json:"ID"`
+	AggrID string `json:"aggr_id"`
+	URL    string `json:"url"`
+
+	CallbackURL string `json:"callback_url"`
+	Extra       string `json:"extra"`
+
+	// CallbackType optionally overrides the transport used to deliver
+	// the callback, selected by default from CallbackURL's scheme (e.g.
+	// "https", "amqp", "kafka", "sqs").
+	CallbackType string `json:"callback_type"`
+
+	// ProgressURL, if set, receives periodic POSTs of interim download
+	// progress while the job is in flight, in addition to the progress
+	// snapshots published on the job's Redis pub/sub channel.
+	ProgressURL string `json:"progress_url"`
+
+	DownloadState State  `json:"download_state"`
+	DownloadMeta  string `json:"download_meta"`
+
+	CallbackState State  `json:"callback_state"`
+	CallbackMeta  string `json:"callback_meta"`
+	CallbackCount int    `json:"callback_count"`
+
+	// NextAttemptAt is the earliest time the notifier should attempt the
+	// next callback delivery. It is populated by the retry policy after
+	// a failed attempt and honoured by Storage.PopCallback.
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+
+	DownloadTimeout time.Duration `json:"-"`
+}
+
+// rawJob mirrors Job but allows us to distinguish an absent field from its
+// zero value during unmarshalling. DownloadTimeout is kept raw so an
+// explicit "download_timeout": null can be rejected instead of silently
+// treated as absent.
+type rawJob struct {
+	AggrID          interface{}     `json:"aggr_id"`
+	URL             string          `json:"url"`
+	CallbackURL     string          `json:"callback_url"`
+	CallbackType    string          `json:"callback_type"`
+	ProgressURL     string          `json:"progress_url"`
+	Extra           string          `json:"extra"`
+	DownloadTimeout json.RawMessage `json:"download_timeout"`
+}
+
+// UnmarshalJSON validates and populates a Job from its JSON representation,
+// as submitted to the API.
+func (j *Job) UnmarshalJSON(data []byte) error {
+	var raw rawJob
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("could not decode job: %v", err)
+	}
+
+	aggrID, ok := raw.AggrID.(string)
+	if !ok || aggrID == "" {
+		return errors.New("aggr_id must be a non-empty string")
+	}
+
+	if _, err := url.ParseRequestURI(raw.URL); err != nil {
+		return fmt.Errorf("invalid url: %v", err)
+	}
+
+	if _, err := url.ParseRequestURI(raw.CallbackURL); err != nil {
+		return fmt.Errorf("invalid callback_url: %v", err)
+	}
+
+	var downloadTimeout int
+	if raw.DownloadTimeout != nil {
+		if err := json.Unmarshal(raw.DownloadTimeout, &downloadTimeout); err != nil {
+			return fmt.Errorf("invalid download_timeout: %v", err)
+		}
+		if downloadTimeout <= 0 {
+			return fmt.Errorf("download_timeout must be a positive number, got %d", downloadTimeout)
+		}
+	}
+
+	j.AggrID = aggrID
+	j.URL = raw.URL
+	j.CallbackURL = raw.CallbackURL
+	j.CallbackType = raw.CallbackType
+	j.ProgressURL = raw.ProgressURL
+	j.Extra = raw.Extra
+	if raw.DownloadTimeout != nil {
+		j.DownloadTimeout = time.Duration(downloadTimeout) * time.Second
+	}
+
+	return nil
+}
@@ -1,12 +1,12 @@
 package notifier
 
 import (
-	"bytes"
+	"context"
 	"crypto/tls"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"path"
@@ -18,7 +18,22 @@ import (
 	"golang.skroutz.gr/skroutz/downloader/storage"
 )
 
-const maxCallbackRetries = 2
+// Default values for the retry policy, the circuit breaker and the reaper.
+// New sets the matching Notifier fields to them. A zero RetryJitter means no
+// jitter, not defaultRetryJitter.
+const (
+	defaultMaxCallbackRetries = 50
+	defaultRetryBase          = time.Second
+	defaultRetryCap           = 5 * time.Minute
+	defaultRetryJitter        = time.Second
+
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = time.Minute
+
+	defaultLeaseTTL        = 30 * time.Second
+	defaultReaperInterval  = 10 * time.Second
+	defaultHeartbeatPeriod = 10 * time.Second
+)
 
 // CallbackInfo holds info to be posted back to the provided callback url.
 type CallbackInfo struct {
@@ -36,14 +51,48 @@ type Notifier struct {
 	Log         *log.Logger
 	DownloadURL *url.URL
 
+	// RetryBase, RetryCap and RetryJitter tune the exponential backoff
+	// applied between callback attempts: the next attempt is scheduled
+	// at min(RetryBase * 2^attempt, RetryCap) + rand(0, RetryJitter).
+	RetryBase   time.Duration
+	RetryCap    time.Duration
+	RetryJitter time.Duration
+
+	// MaxCallbackRetries is the retry ceiling before a callback is
+	// marked as permanently failed.
+	MaxCallbackRetries int
+
+	// BreakerThreshold is the number of consecutive failures for a host
+	// that trips its circuit breaker open. BreakerCooldown is how long
+	// the breaker stays open before allowing a single probe request.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// Transports selects the CallbackTransport used to deliver a job's
+	// callback, keyed by CallbackType or CallbackURL scheme. Callers
+	// can register their own transports without forking the notifier.
+	Transports TransportRegistry
+
+	// LeaseTTL is how long a callback may stay InProgress before the
+	// reaper considers it abandoned by a crashed worker and requeues
+	// it. ReaperInterval is how often the reaper runs.
+	LeaseTTL       time.Duration
+	ReaperInterval time.Duration
+
 	// TODO: These should be exported
 	concurrency int
 	client      *http.Client
 	cbChan      chan job.Job
+
+	breakers   map[string]*hostBreaker
+	breakersMu sync.Mutex
 }
 
-// NewNotifier takes the concurrency of the notifier as an argument
-func New(s *storage.Storage, concurrency int, logger *log.Logger, dwnlURL string) (Notifier, error) {
+// New takes the concurrency of the notifier as an argument. If transports
+// is nil, DefaultTransportRegistry is used with no SecretStore, so HTTP
+// callbacks are sent unsigned and "amqp" callbacks are published through
+// the storage's Redis client.
+func New(s *storage.Storage, concurrency int, logger *log.Logger, dwnlURL string, transports TransportRegistry) (Notifier, error) {
 	url, err := url.ParseRequestURI(dwnlURL)
 	if err != nil {
 		return Notifier{}, fmt.Errorf("Could not parse Download URL, %v", err)
@@ -53,18 +102,37 @@ func New(s *storage.Storage, concurrency int, logger *log.Logger, dwnlURL string
 		return Notifier{}, errors.New("Notifier Concurrency must be a positive number")
 	}
 
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{},
+		},
+		Timeout: time.Duration(3) * time.Second,
+	}
+
+	if transports == nil {
+		transports = DefaultTransportRegistry(client, s.Redis, nil)
+	}
+
 	return Notifier{
 		Storage:     s,
 		Log:         logger,
 		concurrency: concurrency,
-		client: &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{},
-			},
-			Timeout: time.Duration(3) * time.Second,
-		},
+		client:      client,
 		cbChan:      make(chan job.Job),
 		DownloadURL: url,
+		Transports:  transports,
+
+		RetryBase:          defaultRetryBase,
+		RetryCap:           defaultRetryCap,
+		RetryJitter:        defaultRetryJitter,
+		MaxCallbackRetries: defaultMaxCallbackRetries,
+		BreakerThreshold:   defaultBreakerThreshold,
+		BreakerCooldown:    defaultBreakerCooldown,
+
+		LeaseTTL:       defaultLeaseTTL,
+		ReaperInterval: defaultReaperInterval,
+
+		breakers: make(map[string]*hostBreaker),
 	}, nil
 }
 
@@ -86,12 +154,13 @@ func (n *Notifier) Start(closeChan chan struct{}) {
 		}()
 	}
 
-	// Check Redis for jobs left in InProgress state
-	n.collectRogueCallbacks()
+	reaperDone := make(chan struct{})
+	go n.runReaper(reaperDone)
 
 	for {
 		select {
 		case <-closeChan:
+			close(reaperDone)
 			close(n.cbChan)
 			wg.Wait()
 			closeChan <- struct{}{}
@@ -116,92 +185,235 @@ func (n *Notifier) Start(closeChan chan struct{}) {
 	}
 }
 
-// collectRogueCallbacks Scans Redis for jobs that have InProgress CallbackState.
-// This indicates they are leftover from an interrupted previous run and should get requeued.
-func (n *Notifier) collectRogueCallbacks() {
-	var cursor uint64
-	var rogueCount uint64
+// runReaper periodically requeues inflight callbacks whose lease has
+// expired, e.g. because the worker delivering them crashed mid-run. It
+// replaces the old one-shot, SCAN-based rogue callback collection: leases
+// are tracked continuously via MarkInflight/Heartbeat, so there is no
+// O(N) scan of the whole job keyspace and no race with running notifiers.
+func (n *Notifier) runReaper(done <-chan struct{}) {
+	interval := n.ReaperInterval
+	if interval <= 0 {
+		interval = defaultReaperInterval
+	}
 
-	for {
-		var keys []string
-		var err error
-		keys, cursor, err = n.Storage.Redis.Scan(cursor, storage.JobKeyPrefix+"*", 50).Result()
-		if err != nil {
-			n.Log.Println(err)
-			break
-		}
+	t := time.NewTicker(interval)
+	defer t.Stop()
 
-		for _, jobID := range keys {
-			strCmd := n.Storage.Redis.HGet(jobID, "CallbackState")
-			if strCmd.Err() != nil {
-				n.Log.Println(strCmd.Err())
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			ids, err := n.Storage.Reap()
+			if err != nil {
+				n.Log.Println(err)
 				continue
 			}
-			if job.State(strCmd.Val()) == job.StateInProgress {
-				jb, err := n.Storage.GetJob(strings.TrimPrefix(jobID, storage.JobKeyPrefix))
-				if err != nil {
-					n.Log.Printf("Could not get job for Redis: %v", err)
-					continue
-				}
-				err = n.Storage.QueuePendingCallback(&jb)
-				if err != nil {
-					n.Log.Printf("Could not queue job for download: %v", err)
-					continue
-				}
-				rogueCount++
+			if len(ids) > 0 {
+				n.Log.Printf("Reaped %d abandoned callbacks: %s", len(ids), strings.Join(ids, ", "))
 			}
 		}
-
-		if cursor == 0 {
-			break
-		}
-	}
-
-	if rogueCount > 0 {
-		n.Log.Printf("Queued %d rogue callbacks", rogueCount)
 	}
 }
 
 // Notify posts callback info to j.CallbackURL
 func (n *Notifier) Notify(j *job.Job) error {
-	j.CallbackCount++
-
 	err := n.markCbInProgress(j)
 	if err != nil {
 		return err
 	}
 
+	host, err := callbackHost(j.CallbackURL)
+	if err != nil {
+		j.CallbackCount++
+		return n.markCbFailed(j, err.Error())
+	}
+
+	// A breaker-open skip is not a real delivery attempt, so it must
+	// not consume MaxCallbackRetries: otherwise enough flapping-host
+	// skips would exhaust the retry ceiling and permanently drop a
+	// callback that was never actually attempted past the handful of
+	// failures that originally tripped the breaker.
+	if b := n.breaker(host); b.isOpen() && !b.allowProbe() {
+		return n.rescheduleBreakerOpen(j, host)
+	}
+
+	j.CallbackCount++
+
 	cbInfo, err := n.getCallbackInfo(j)
 	if err != nil {
 		return n.markCbFailed(j, err.Error())
 	}
 
-	cb, err := json.Marshal(cbInfo)
+	transport, err := n.transportFor(j)
 	if err != nil {
 		return n.markCbFailed(j, err.Error())
 	}
 
-	res, err := n.client.Post(j.CallbackURL, "application/json", bytes.NewBuffer(cb))
-	if err != nil || res.StatusCode < 200 || res.StatusCode >= 300 {
-		if err == nil {
-			err = fmt.Errorf("Received Status: %s", res.Status)
-		}
+	stopHeartbeat := make(chan struct{})
+	go n.heartbeat(j, stopHeartbeat)
+	err = transport.Deliver(context.Background(), j, cbInfo)
+	close(stopHeartbeat)
+
+	if err != nil {
+		n.breaker(host).recordFailure(n.BreakerThreshold, n.BreakerCooldown)
 		return n.retryOrFail(j, err.Error())
 	}
 
+	n.breaker(host).recordSuccess()
+	if err := n.Storage.ClearInflight(j.ID); err != nil {
+		n.Log.Printf("Could not clear inflight lease for job %s: %v", j.ID, err)
+	}
 	return n.Storage.RemoveJob(j.ID)
 }
 
-// retryOrFail checks the callback count of the current download
-// and retries the callback if its Retry Counts < maxRetries else it marks
-// it as failed
+// retryOrFail checks the callback count of the current download and
+// schedules the next attempt using an exponential backoff with jitter, or
+// marks the callback as permanently failed if MaxCallbackRetries has been
+// exceeded.
 func (n *Notifier) retryOrFail(j *job.Job, err string) error {
-	if j.CallbackCount >= maxCallbackRetries {
+	maxRetries := n.MaxCallbackRetries
+	if maxRetries <= 0 {
+		maxRetries = defaultMaxCallbackRetries
+	}
+	if j.CallbackCount >= maxRetries {
 		return n.markCbFailed(j, err)
 	}
+
+	if cerr := n.Storage.ClearInflight(j.ID); cerr != nil {
+		n.Log.Printf("Could not clear inflight lease for job %s: %v", j.ID, cerr)
+	}
+	j.NextAttemptAt = time.Now().Add(n.nextBackoff(j.CallbackCount))
+	return n.Storage.QueuePendingCallback(j)
+}
+
+// rescheduleBreakerOpen requeues j for a later attempt without touching
+// CallbackCount or MaxCallbackRetries: the host's breaker being open means
+// delivery was never actually attempted, so it must not count against the
+// job's retry budget. The job is retried once the breaker's cooldown has
+// elapsed, at which point it either finds the breaker closed or becomes the
+// half-open probe itself.
+func (n *Notifier) rescheduleBreakerOpen(j *job.Job, host string) error {
+	n.Log.Printf("Skipping callback for job %s: circuit breaker open for host %s", j.ID, host)
+
+	if err := n.Storage.ClearInflight(j.ID); err != nil {
+		n.Log.Printf("Could not clear inflight lease for job %s: %v", j.ID, err)
+	}
+
+	cooldown := n.BreakerCooldown
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	j.NextAttemptAt = time.Now().Add(cooldown)
 	return n.Storage.QueuePendingCallback(j)
 }
 
+// nextBackoff computes min(RetryBase * 2^attempt, RetryCap) + rand(0, RetryJitter).
+func (n *Notifier) nextBackoff(attempt int) time.Duration {
+	base, ceiling, jitter := n.RetryBase, n.RetryCap, n.RetryJitter
+	if base <= 0 {
+		base = defaultRetryBase
+	}
+	if ceiling <= 0 {
+		ceiling = defaultRetryCap
+	}
+
+	delay := base * time.Duration(1<<uint(attempt))
+	if delay > ceiling || delay <= 0 {
+		delay = ceiling
+	}
+	if jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(jitter)))
+	}
+	return delay
+}
+
+// callbackHost extracts the host part of a callback URL, used as the
+// circuit breaker key.
+func callbackHost(callbackURL string) (string, error) {
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return "", fmt.Errorf("could not parse callback URL: %v", err)
+	}
+	return u.Host, nil
+}
+
+// breaker returns the hostBreaker for host, creating it if it doesn't exist.
+func (n *Notifier) breaker(host string) *hostBreaker {
+	n.breakersMu.Lock()
+	defer n.breakersMu.Unlock()
+
+	b, ok := n.breakers[host]
+	if !ok {
+		b = &hostBreaker{}
+		n.breakers[host] = b
+	}
+	return b
+}
+
+// hostBreaker tracks consecutive delivery failures for a single callback
+// host and trips open once they reach a threshold, so that a single bad
+// receiver cannot burn worker slots or exhaust retries for everyone else.
+type hostBreaker struct {
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	open     bool
+	probing  bool
+	cooldown time.Duration
+}
+
+// isOpen reports whether the breaker is currently open.
+func (b *hostBreaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
+
+// allowProbe allows a single half-open probe request through once the
+// cooldown window has elapsed, closing the breaker on a subsequent success.
+func (b *hostBreaker) allowProbe() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open || b.probing {
+		return false
+	}
+	if time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// recordFailure registers a delivery failure, tripping the breaker open
+// once threshold consecutive failures have been observed.
+func (b *hostBreaker) recordFailure(threshold int, cooldown time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.cooldown = cooldown
+	b.probing = false
+	b.failures++
+	if threshold <= 0 {
+		threshold = defaultBreakerThreshold
+	}
+	if b.failures >= threshold {
+		b.open = true
+		b.openedAt = time.Now()
+	}
+}
+
+// recordSuccess registers a successful delivery, closing the breaker.
+func (b *hostBreaker) recordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.open = false
+	b.probing = false
+}
+
 // callbackInfo validates that the job is good for callback and
 // return callbackInfo to the caller
 func (n *Notifier) getCallbackInfo(j *job.Job) (CallbackInfo, error) {
@@ -230,12 +442,46 @@ func jobDownloadURL(j *job.Job, downloadURL url.URL) string {
 func (n *Notifier) markCbInProgress(j *job.Job) error {
 	j.CallbackState = job.StateInProgress
 	j.CallbackMeta = ""
-	return n.Storage.SaveJob(j)
+	if err := n.Storage.SaveJob(j); err != nil {
+		return err
+	}
+
+	leaseTTL := n.LeaseTTL
+	if leaseTTL <= 0 {
+		leaseTTL = defaultLeaseTTL
+	}
+	return n.Storage.MarkInflight(j.ID, leaseTTL)
+}
+
+// heartbeat renews j's inflight lease every defaultHeartbeatPeriod until
+// stop is closed, so a slow-but-healthy delivery isn't reaped mid-flight.
+func (n *Notifier) heartbeat(j *job.Job, stop <-chan struct{}) {
+	leaseTTL := n.LeaseTTL
+	if leaseTTL <= 0 {
+		leaseTTL = defaultLeaseTTL
+	}
+
+	t := time.NewTicker(defaultHeartbeatPeriod)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			if err := n.Storage.Heartbeat(j.ID, leaseTTL); err != nil {
+				n.Log.Printf("Heartbeat error for job %s: %v", j.ID, err)
+			}
+		}
+	}
 }
 
 func (n *Notifier) markCbFailed(j *job.Job, meta ...string) error {
 	j.CallbackState = job.StateFailed
 	j.CallbackMeta = strings.Join(meta, "\n")
 	n.Log.Printf("Callback failed: {%s, %s}, destination %s", j.ID, j.AggrID, j.CallbackURL)
+	if err := n.Storage.ClearInflight(j.ID); err != nil {
+		n.Log.Printf("Could not clear inflight lease for job %s: %v", j.ID, err)
+	}
 	return n.Storage.SaveJob(j)
 }
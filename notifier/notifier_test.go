@@ -0,0 +1,126 @@
+package notifier
+
+import (
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"gopkg.in/redis.v6"
+
+	"golang.skroutz.gr/skroutz/downloader/job"
+	"golang.skroutz.gr/skroutz/downloader/storage"
+)
+
+func newTestStorage(t *testing.T) *storage.Storage {
+	t.Helper()
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("could not start miniredis: %v", err)
+	}
+	t.Cleanup(mr.Close)
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	return storage.New(client)
+}
+
+func TestNextBackoff(t *testing.T) {
+	n := &Notifier{RetryBase: time.Second, RetryCap: 5 * time.Minute, RetryJitter: 0}
+
+	cases := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{10, 5 * time.Minute}, // clamped to RetryCap
+	}
+
+	for _, c := range cases {
+		got := n.nextBackoff(c.attempt)
+		if got != c.want {
+			t.Errorf("nextBackoff(%d) = %s, want %s", c.attempt, got, c.want)
+		}
+	}
+}
+
+func TestNextBackoffJitter(t *testing.T) {
+	n := &Notifier{RetryBase: time.Second, RetryCap: time.Minute, RetryJitter: time.Second}
+
+	for i := 0; i < 20; i++ {
+		got := n.nextBackoff(0)
+		if got < time.Second || got >= 2*time.Second {
+			t.Fatalf("nextBackoff with jitter = %s, want in [1s, 2s)", got)
+		}
+	}
+}
+
+func TestHostBreakerTripsAndRecovers(t *testing.T) {
+	b := &hostBreaker{}
+
+	for i := 0; i < 2; i++ {
+		b.recordFailure(3, time.Minute)
+	}
+	if b.isOpen() {
+		t.Fatal("breaker should still be closed before reaching the threshold")
+	}
+
+	b.recordFailure(3, time.Minute)
+	if !b.isOpen() {
+		t.Fatal("breaker should be open after reaching the threshold")
+	}
+
+	if b.allowProbe() {
+		t.Fatal("breaker should not allow a probe before the cooldown elapses")
+	}
+
+	b.openedAt = time.Now().Add(-2 * time.Minute)
+	if !b.allowProbe() {
+		t.Fatal("breaker should allow a single probe after the cooldown elapses")
+	}
+	if b.allowProbe() {
+		t.Fatal("breaker should not allow a second concurrent probe")
+	}
+
+	b.recordSuccess()
+	if b.isOpen() {
+		t.Fatal("breaker should close after a successful probe")
+	}
+}
+
+// TestNotifyDoesNotConsumeRetriesWhenBreakerOpen ensures that callbacks
+// skipped because a host's circuit breaker is open are rescheduled without
+// touching CallbackCount, so a flapping host can't burn through
+// MaxCallbackRetries before a delivery is ever actually attempted.
+func TestNotifyDoesNotConsumeRetriesWhenBreakerOpen(t *testing.T) {
+	s := newTestStorage(t)
+	n := &Notifier{
+		Storage:            s,
+		Log:                log.New(io.Discard, "", 0),
+		BreakerThreshold:   1,
+		BreakerCooldown:    time.Minute,
+		MaxCallbackRetries: 1,
+		breakers:           make(map[string]*hostBreaker),
+	}
+
+	j := &job.Job{ID: "job-1", CallbackURL: "http://example.com/cb", DownloadState: job.StateSuccess}
+
+	n.breaker("example.com").recordFailure(n.BreakerThreshold, n.BreakerCooldown)
+
+	for i := 0; i < 3; i++ {
+		if err := n.Notify(j); err != nil {
+			t.Fatalf("Notify: %v", err)
+		}
+	}
+
+	if j.CallbackCount != 0 {
+		t.Fatalf("CallbackCount = %d after breaker-open skips, want 0", j.CallbackCount)
+	}
+	if j.CallbackState == job.StateFailed {
+		t.Fatal("job was marked permanently failed by breaker-open skips alone")
+	}
+}
@@ -0,0 +1,101 @@
+package notifier
+
+import (
+	"bytes"
+	"time"
+
+	"golang.skroutz.gr/skroutz/downloader/job"
+	"golang.skroutz.gr/skroutz/downloader/processor"
+)
+
+// ProgressThrottle is the minimum interval between two progress POSTs for
+// the same job, mirroring processor.ProgressThrottle so a job's
+// ProgressURL never gets more traffic than its pub/sub channel does.
+const ProgressThrottle = processor.ProgressThrottle
+
+// RelayProgress subscribes to j's progress channel and POSTs each
+// snapshot to j.ProgressURL, rate-limited to at most one request per
+// ProgressThrottle, until j reaches a terminal download state or stop
+// fires. It is a no-op if j.ProgressURL is empty. Processor.Process calls
+// this for every job with a ProgressURL as it starts a download, when the
+// Processor's Relayer is set.
+func (n *Notifier) RelayProgress(j *job.Job, stop <-chan struct{}) {
+	if j.ProgressURL == "" {
+		return
+	}
+
+	sub := n.Storage.Redis.Subscribe(processor.ProgressChannel(j.ID))
+	defer sub.Close()
+
+	recvDone := make(chan struct{})
+	defer close(recvDone)
+
+	msgs := make(chan string)
+	go func() {
+		for {
+			msg, err := sub.ReceiveMessage()
+			if err != nil {
+				return
+			}
+			select {
+			case msgs <- msg.Payload:
+			case <-recvDone:
+				return
+			}
+		}
+	}()
+
+	var lastSent time.Time
+	var pending string
+	t := time.NewTicker(ProgressThrottle)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case payload, ok := <-msgs:
+			if !ok {
+				return
+			}
+			pending = payload
+			if time.Since(lastSent) >= ProgressThrottle {
+				n.postProgress(j, pending)
+				lastSent = time.Now()
+				pending = ""
+				// Restart the ticker, dropping any tick already
+				// buffered, so the next coalesced POST comes no
+				// sooner than ProgressThrottle after this one.
+				t.Reset(ProgressThrottle)
+				select {
+				case <-t.C:
+				default:
+				}
+			}
+		case <-t.C:
+			if pending != "" {
+				n.postProgress(j, pending)
+				lastSent = time.Now()
+				pending = ""
+			}
+
+			cur, err := n.Storage.GetJob(j.ID)
+			if err != nil {
+				continue
+			}
+			if cur.DownloadState == job.StateSuccess || cur.DownloadState == job.StateFailed {
+				return
+			}
+		}
+	}
+}
+
+// postProgress POSTs a raw processor.Progress JSON payload to j.ProgressURL.
+func (n *Notifier) postProgress(j *job.Job, payload string) {
+	res, err := n.client.Post(j.ProgressURL, "application/json", bytes.NewBufferString(payload))
+	if err != nil {
+		n.Log.Printf("Progress POST error for job %s: %v", j.ID, err)
+		return
+	}
+	defer res.Body.Close()
+}
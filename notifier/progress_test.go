@@ -0,0 +1,97 @@
+package notifier
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.skroutz.gr/skroutz/downloader/job"
+	"golang.skroutz.gr/skroutz/downloader/processor"
+)
+
+func TestRelayProgressThrottlesPosts(t *testing.T) {
+	s := newTestStorage(t)
+
+	var posts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&posts, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	n := &Notifier{Storage: s, Log: log.New(io.Discard, "", 0), client: srv.Client()}
+	j := &job.Job{ID: "job-1", ProgressURL: srv.URL, DownloadState: job.StateInProgress}
+	if err := s.SaveJob(j); err != nil {
+		t.Fatalf("SaveJob: %v", err)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		n.RelayProgress(j, stop)
+		close(done)
+	}()
+
+	// Give RelayProgress's Subscribe a moment to register with Redis
+	// before publishing, mirroring the same synchronization used by
+	// xfer's coalescing test.
+	time.Sleep(50 * time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		s.Redis.Publish(processor.ProgressChannel(j.ID), "{}")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if got := atomic.LoadInt32(&posts); got != 1 {
+		t.Fatalf("posts after a burst of 5 messages = %d, want 1 (throttled)", got)
+	}
+
+	time.Sleep(ProgressThrottle)
+	if got := atomic.LoadInt32(&posts); got < 2 {
+		t.Fatalf("posts after waiting out the throttle = %d, want >= 2", got)
+	}
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("RelayProgress did not return after stop was closed")
+	}
+}
+
+func TestRelayProgressStopsOnTerminalState(t *testing.T) {
+	s := newTestStorage(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	n := &Notifier{Storage: s, Log: log.New(io.Discard, "", 0), client: srv.Client()}
+	j := &job.Job{ID: "job-2", ProgressURL: srv.URL, DownloadState: job.StateInProgress}
+	if err := s.SaveJob(j); err != nil {
+		t.Fatalf("SaveJob: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		n.RelayProgress(j, make(chan struct{}))
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	j.DownloadState = job.StateSuccess
+	if err := s.SaveJob(j); err != nil {
+		t.Fatalf("SaveJob: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * ProgressThrottle):
+		t.Fatal("RelayProgress did not stop once the job reached a terminal state")
+	}
+}
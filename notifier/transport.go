@@ -0,0 +1,194 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/redis.v6"
+
+	"golang.skroutz.gr/skroutz/downloader/job"
+)
+
+// CallbackTransport delivers a job's CallbackInfo to its destination. Which
+// transport handles a given job is decided by TransportRegistry, based on
+// the job's CallbackType or the scheme of its CallbackURL.
+type CallbackTransport interface {
+	Deliver(ctx context.Context, j *job.Job, info CallbackInfo) error
+}
+
+// TransportRegistry maps a callback type (a URL scheme such as "https" or
+// "amqp", or an explicit job.Job.CallbackType) to the CallbackTransport
+// that handles it. Callers can register their own transports without
+// forking the notifier.
+type TransportRegistry map[string]CallbackTransport
+
+// DefaultTransportRegistry returns the built-in transports: a signing HTTP
+// transport for "http"/"https" and an AMQP transport for "amqp", published
+// via redisClient so it works out of the box without pulling in a
+// broker-specific client library.
+func DefaultTransportRegistry(client *http.Client, redisClient *redis.Client, secrets SecretStore) TransportRegistry {
+	httpTransport := &HTTPTransport{Client: client, Secrets: secrets}
+	return TransportRegistry{
+		"http":  httpTransport,
+		"https": httpTransport,
+		"amqp":  &AMQPTransport{Publisher: &RedisPublisher{Redis: redisClient}},
+	}
+}
+
+// transportFor selects the CallbackTransport for j, preferring an explicit
+// CallbackType over the CallbackURL's scheme.
+func (n *Notifier) transportFor(j *job.Job) (CallbackTransport, error) {
+	key := j.CallbackType
+	if key == "" {
+		u, err := url.Parse(j.CallbackURL)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse callback URL: %v", err)
+		}
+		key = u.Scheme
+	}
+
+	t, ok := n.Transports[key]
+	if !ok {
+		return nil, fmt.Errorf("no callback transport registered for %q", key)
+	}
+	return t, nil
+}
+
+// SecretStore looks up the HMAC signing secret configured for an
+// aggregation, if any. A SecretStore returning ("", false) disables
+// signing for that aggregation.
+type SecretStore interface {
+	Secret(aggrID string) (secret string, ok bool)
+}
+
+// SignatureHeader is the header HTTPTransport sets with the computed
+// HMAC-SHA256 signature, when signing is enabled.
+const SignatureHeader = "X-Downloader-Signature"
+
+// TimestampHeader carries the Unix timestamp the signature was computed
+// over, so receivers can reject stale replayed requests.
+const TimestampHeader = "X-Downloader-Timestamp"
+
+// HTTPTransport delivers callbacks as a JSON POST request, as the notifier
+// has always done, optionally signing the request body with HMAC-SHA256 so
+// receivers can authenticate the sender and reject replays.
+type HTTPTransport struct {
+	Client  *http.Client
+	Secrets SecretStore
+}
+
+// Deliver POSTs info as JSON to j.CallbackURL.
+func (t *HTTPTransport) Deliver(ctx context.Context, j *job.Job, info CallbackInfo) error {
+	body, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, j.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	if t.Secrets != nil {
+		if secret, ok := t.Secrets.Secret(j.AggrID); ok {
+			ts := strconv.FormatInt(time.Now().Unix(), 10)
+			req.Header.Set(TimestampHeader, ts)
+			req.Header.Set(SignatureHeader, sign(secret, ts, body))
+		}
+	}
+
+	res, err := t.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("received status: %s", res.Status)
+	}
+	return nil
+}
+
+// sign computes the HMAC-SHA256 signature over the timestamp and body,
+// preventing replay of a captured request after its timestamp expires.
+func sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// AMQPPublisher publishes a message to an AMQP exchange/queue derived from
+// a callback URL, e.g. amqp://host/exchange. It is satisfied by a thin
+// wrapper around an amqp.Channel, kept out of this package to avoid a hard
+// dependency on a specific AMQP client library.
+type AMQPPublisher interface {
+	Publish(url string, body []byte) error
+}
+
+// AMQPTransport delivers callbacks by publishing them as JSON messages to
+// an AMQP broker, for pipelines that prefer a message queue over a
+// synchronous HTTP callback.
+type AMQPTransport struct {
+	Publisher AMQPPublisher
+}
+
+// Deliver publishes info to the exchange/queue encoded in j.CallbackURL.
+func (t *AMQPTransport) Deliver(ctx context.Context, j *job.Job, info CallbackInfo) error {
+	if t.Publisher == nil {
+		return errors.New("AMQPTransport: no publisher configured")
+	}
+
+	body, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return t.Publisher.Publish(j.CallbackURL, body)
+}
+
+// RedisPublisher is the default AMQPPublisher: it publishes to a Redis
+// pub/sub channel named after the callback URL's path instead of a real
+// broker exchange, e.g. amqp://broker/my-exchange publishes to channel
+// "my-exchange". This keeps AMQPTransport functional out of the box on the
+// Redis deployment the rest of the notifier already requires, without
+// pulling in a broker-specific client library; callers who want a real
+// AMQP broker can supply their own AMQPPublisher instead.
+type RedisPublisher struct {
+	Redis *redis.Client
+}
+
+// Publish publishes body to the Redis channel encoded in url.
+func (p *RedisPublisher) Publish(url string, body []byte) error {
+	channel, err := amqpChannel(url)
+	if err != nil {
+		return err
+	}
+	return p.Redis.Publish(channel, string(body)).Err()
+}
+
+// amqpChannel extracts the exchange/queue name from an amqp:// callback
+// URL's path, e.g. "amqp://broker/my-exchange" yields "my-exchange".
+func amqpChannel(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("could not parse callback URL: %v", err)
+	}
+	channel := strings.TrimPrefix(u.Path, "/")
+	if channel == "" {
+		return "", fmt.Errorf("callback URL %q has no exchange/queue path", rawURL)
+	}
+	return channel, nil
+}
@@ -0,0 +1,129 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"gopkg.in/redis.v6"
+
+	"golang.skroutz.gr/skroutz/downloader/job"
+)
+
+type fakeSecrets map[string]string
+
+func (f fakeSecrets) Secret(aggrID string) (string, bool) {
+	s, ok := f[aggrID]
+	return s, ok
+}
+
+func TestHTTPTransportSignsWhenSecretConfigured(t *testing.T) {
+	var gotSig, gotTs string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotSig = r.Header.Get(SignatureHeader)
+		gotTs = r.Header.Get(TimestampHeader)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	transport := &HTTPTransport{
+		Client:  srv.Client(),
+		Secrets: fakeSecrets{"aggr-1": "s3cr3t"},
+	}
+
+	j := &job.Job{ID: "job-1", AggrID: "aggr-1", CallbackURL: srv.URL}
+	info := CallbackInfo{Success: true}
+
+	if err := transport.Deliver(context.Background(), j, info); err != nil {
+		t.Fatalf("Deliver returned error: %v", err)
+	}
+
+	if gotSig == "" {
+		t.Fatal("expected a signature header, got none")
+	}
+
+	body, _ := json.Marshal(info)
+	want := sign("s3cr3t", gotTs, body)
+	if gotSig != want {
+		t.Errorf("signature = %q, want %q", gotSig, want)
+	}
+}
+
+func TestHTTPTransportSkipsSigningWithoutSecret(t *testing.T) {
+	var gotSig string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotSig = r.Header.Get(SignatureHeader)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	transport := &HTTPTransport{Client: srv.Client(), Secrets: fakeSecrets{}}
+	j := &job.Job{ID: "job-1", AggrID: "aggr-unknown", CallbackURL: srv.URL}
+
+	if err := transport.Deliver(context.Background(), j, CallbackInfo{}); err != nil {
+		t.Fatalf("Deliver returned error: %v", err)
+	}
+
+	if gotSig != "" {
+		t.Errorf("expected no signature header, got %q", gotSig)
+	}
+}
+
+func TestAMQPTransportDeliverErrorsWithoutPublisher(t *testing.T) {
+	transport := &AMQPTransport{}
+	j := &job.Job{ID: "job-1", CallbackURL: "amqp://broker/my-exchange"}
+
+	if err := transport.Deliver(context.Background(), j, CallbackInfo{}); err == nil {
+		t.Fatal("expected an error when no Publisher is configured")
+	}
+}
+
+func TestRedisPublisherPublishesToChannelFromURL(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("could not start miniredis: %v", err)
+	}
+	defer mr.Close()
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+
+	sub := client.Subscribe("my-exchange")
+	defer sub.Close()
+	if _, err := sub.Receive(); err != nil {
+		t.Fatalf("could not confirm subscription: %v", err)
+	}
+
+	transport := &AMQPTransport{Publisher: &RedisPublisher{Redis: client}}
+	j := &job.Job{ID: "job-1", CallbackURL: "amqp://broker/my-exchange", AggrID: "aggr-1"}
+	info := CallbackInfo{Success: true, DownloadURL: "http://dl.example.com/job-1"}
+
+	if err := transport.Deliver(context.Background(), j, info); err != nil {
+		t.Fatalf("Deliver returned error: %v", err)
+	}
+
+	msgCh := make(chan string, 1)
+	go func() {
+		msg, err := sub.ReceiveMessage()
+		if err == nil {
+			msgCh <- msg.Payload
+		}
+	}()
+
+	select {
+	case payload := <-msgCh:
+		var got CallbackInfo
+		if err := json.Unmarshal([]byte(payload), &got); err != nil {
+			t.Fatalf("could not decode published message: %v", err)
+		}
+		if got != info {
+			t.Errorf("published CallbackInfo = %+v, want %+v", got, info)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no message was published to the exchange's channel")
+	}
+}
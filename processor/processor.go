@@ -0,0 +1,108 @@
+// Package processor performs the actual download of a job's resource and
+// persists it to the configured storage directory.
+package processor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"gopkg.in/redis.v6"
+
+	"golang.skroutz.gr/skroutz/downloader/job"
+	"golang.skroutz.gr/skroutz/downloader/storage"
+	"golang.skroutz.gr/skroutz/downloader/xfer"
+)
+
+// Processor fetches job URLs over HTTP and stores the result under
+// StorageDir, reporting progress as it goes. Concurrent jobs for the same
+// URL are coalesced by an internal xfer.TransferManager instead of each
+// triggering their own HTTP request.
+type Processor struct {
+	StorageDir string
+	Client     *http.Client
+	Redis      *redis.Client
+
+	// Relayer, if set, is used to POST interim progress to a job's
+	// ProgressURL for the lifetime of its download.
+	Relayer ProgressRelayer
+
+	transfers *xfer.TransferManager
+}
+
+// ProgressRelayer POSTs interim progress snapshots to j.ProgressURL until
+// j finishes downloading or stop fires. It is implemented by
+// *notifier.Notifier.
+type ProgressRelayer interface {
+	RelayProgress(j *job.Job, stop <-chan struct{})
+}
+
+// NewProcessor returns a Processor that stores downloads under storageDir
+// and deduplicates concurrent fetches of the same URL via s and an
+// internal xfer.TransferManager.
+func NewProcessor(storageDir string, client *http.Client, redisClient *redis.Client, s *storage.Storage) *Processor {
+	p := &Processor{StorageDir: storageDir, Client: client, Redis: redisClient}
+	p.transfers = xfer.NewTransferManager(s, p)
+	return p
+}
+
+// Process downloads j's URL, coalescing it with any other in-flight job
+// for the same URL. It returns once j has been attached to its transfer;
+// the fetch and job completion happen asynchronously, same as
+// xfer.TransferManager.Enqueue. If j has a ProgressURL and a Relayer is
+// configured, interim progress is POSTed to it until the download ends.
+func (p *Processor) Process(j *job.Job) {
+	if p.Relayer != nil && j.ProgressURL != "" {
+		// RelayProgress returns on its own once j reaches a terminal
+		// download state, so no external stop signal is needed here.
+		go p.Relayer.RelayProgress(j, make(chan struct{}))
+	}
+
+	p.transfers.Enqueue(j, filepath.Join(p.StorageDir, j.ID))
+}
+
+// Fetch downloads url into dst, publishing throttled progress snapshots
+// as the response body is read. It satisfies xfer.Fetcher, so the
+// TransferManager can use it as the underlying fetch for a Transfer.
+func (p *Processor) Fetch(ctx context.Context, url, dst string) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("could not build request for %s: %v", url, err)
+	}
+	req = req.WithContext(ctx)
+
+	res, err := p.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not fetch %s: %v", url, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("received status %s for %s", res.Status, url)
+	}
+
+	var total int64
+	if cl := res.Header.Get("Content-Length"); cl != "" {
+		total, _ = strconv.ParseInt(cl, 10, 64)
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("could not create %s: %v", dst, err)
+	}
+	defer out.Close()
+
+	// The transfer's progress is published under the ID of the job
+	// that originated it (dst's basename), since that is the only job
+	// guaranteed to exist for the lifetime of the fetch.
+	body := newProgressReader(res.Body, p.Redis, filepath.Base(dst), total)
+	if _, err := io.Copy(out, body); err != nil {
+		return fmt.Errorf("could not write %s: %v", dst, err)
+	}
+
+	return nil
+}
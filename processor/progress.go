@@ -0,0 +1,102 @@
+package processor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"gopkg.in/redis.v6"
+)
+
+// ProgressChannelPrefix namespaces the Redis pub/sub channel a job's
+// progress snapshots are published to.
+const ProgressChannelPrefix = "progress:"
+
+// ProgressThrottle is the minimum interval between two published progress
+// snapshots for the same download. The snapshot of the final read is
+// published regardless of it.
+const ProgressThrottle = 500 * time.Millisecond
+
+// Progress is a snapshot of an in-flight download, published to
+// ProgressChannelPrefix+jobID and optionally POSTed to a job's
+// ProgressURL.
+type Progress struct {
+	BytesDone  int64   `json:"bytes_done"`
+	BytesTotal int64   `json:"bytes_total"`
+	SpeedBps   float64 `json:"speed_bps"`
+	ETASeconds float64 `json:"eta_s"`
+}
+
+// progressReader wraps an HTTP response body, publishing a throttled
+// Progress snapshot to Redis as bytes are read, so UIs can render a
+// download bar for aggregated jobs instead of only seeing the terminal
+// callback.
+type progressReader struct {
+	io.Reader
+
+	redis *redis.Client
+	jobID string
+	total int64
+
+	start      time.Time
+	done       int64
+	lastReport time.Time
+}
+
+// newProgressReader returns a progressReader that publishes snapshots for
+// jobID over client, assuming total bytes overall (0 if unknown).
+func newProgressReader(r io.Reader, client *redis.Client, jobID string, total int64) *progressReader {
+	return &progressReader{
+		Reader: r,
+		redis:  client,
+		jobID:  jobID,
+		total:  total,
+		start:  time.Now(),
+	}
+}
+
+// Read implements io.Reader, publishing a throttled progress snapshot after
+// each underlying read. The final read (EOF or any other terminal error)
+// always publishes, regardless of throttling, so a listener never misses
+// the completion snapshot while waiting on the next throttled tick.
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.Reader.Read(b)
+	p.done += int64(n)
+
+	if err != nil || (n > 0 && time.Since(p.lastReport) >= ProgressThrottle) {
+		p.publish()
+		p.lastReport = time.Now()
+	}
+	return n, err
+}
+
+// publish emits the current Progress snapshot on the job's channel.
+func (p *progressReader) publish() {
+	elapsed := time.Since(p.start).Seconds()
+	var speed, eta float64
+	if elapsed > 0 {
+		speed = float64(p.done) / elapsed
+	}
+	if speed > 0 && p.total > p.done {
+		eta = float64(p.total-p.done) / speed
+	}
+
+	body, err := json.Marshal(Progress{
+		BytesDone:  p.done,
+		BytesTotal: p.total,
+		SpeedBps:   speed,
+		ETASeconds: eta,
+	})
+	if err != nil {
+		return
+	}
+
+	p.redis.Publish(ProgressChannel(p.jobID), string(body))
+}
+
+// ProgressChannel returns the Redis pub/sub channel name jobID's progress
+// snapshots are published on.
+func ProgressChannel(jobID string) string {
+	return fmt.Sprintf("%s%s", ProgressChannelPrefix, jobID)
+}
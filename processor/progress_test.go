@@ -0,0 +1,54 @@
+package processor
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"gopkg.in/redis.v6"
+)
+
+func TestProgressReaderPublishesFinalSnapshotOnEOF(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("could not start miniredis: %v", err)
+	}
+	defer mr.Close()
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+
+	sub := client.Subscribe(ProgressChannel("job-eof"))
+	defer sub.Close()
+
+	body := "hello world"
+	r := newProgressReader(strings.NewReader(body), client, "job-eof", int64(len(body)))
+
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		t.Fatalf("io.Copy: %v", err)
+	}
+
+	msgCh := make(chan string, 1)
+	go func() {
+		msg, err := sub.ReceiveMessage()
+		if err == nil {
+			msgCh <- msg.Payload
+		}
+	}()
+
+	select {
+	case payload := <-msgCh:
+		var p Progress
+		if err := json.Unmarshal([]byte(payload), &p); err != nil {
+			t.Fatalf("could not decode progress: %v", err)
+		}
+		if p.BytesDone != int64(len(body)) {
+			t.Errorf("final snapshot BytesDone = %d, want %d", p.BytesDone, len(body))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no final progress snapshot was published on EOF")
+	}
+}
@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"gopkg.in/redis.v6"
+
+	"golang.skroutz.gr/skroutz/downloader/job"
+)
+
+// InflightQueue is the Redis ZSET tracking jobs whose callback is currently
+// being delivered, scored by the Unix timestamp their lease expires at.
+// Reap uses it to find and requeue callbacks abandoned by a crashed
+// worker, replacing the old one-shot SCAN-based collectRogueCallbacks.
+const InflightQueue = "callbacks:inflight"
+
+// reapScript double-checks each candidate's lease is still expired (a
+// heartbeat may have just renewed it) and its callback state is still
+// InProgress, then re-queues it onto PendingCallbackQueue, all within a
+// single EVAL so the reaper never races a worker that is mid-delivery.
+//
+// Every key the script touches — including each job:<id> hash — is passed
+// in via KEYS rather than built by Lua string concatenation, so a
+// Redis Cluster client can route the EVAL correctly instead of the script
+// reaching for keys the cluster never saw declared.
+// KEYS[1] is InflightQueue, KEYS[2] is PendingCallbackQueue, and KEYS[3:]
+// are the candidate jobs' job:<id> keys, with ARGV[3:] holding the matching
+// job IDs in the same order.
+const reapScript = `
+local inflightKey = KEYS[1]
+local pendingKey = KEYS[2]
+local now = tonumber(ARGV[1])
+local inProgress = ARGV[2]
+local reaped = {}
+
+for i = 3, #KEYS do
+	local jobKey = KEYS[i]
+	local id = ARGV[i]
+
+	local score = redis.call('ZSCORE', inflightKey, id)
+	if score and tonumber(score) <= now then
+		redis.call('ZREM', inflightKey, id)
+		local state = redis.call('HGET', jobKey, 'CallbackState')
+		if state == inProgress then
+			redis.call('ZADD', pendingKey, now, id)
+			table.insert(reaped, id)
+		end
+	end
+end
+
+return reaped
+`
+
+// MarkInflight records that j's callback delivery started, with a lease
+// that expires after leaseTTL unless renewed via Heartbeat. It should be
+// called alongside markCbInProgress.
+func (s *Storage) MarkInflight(jobID string, leaseTTL time.Duration) error {
+	return s.Redis.ZAdd(InflightQueue, redis.Z{
+		Score:  float64(time.Now().Add(leaseTTL).Unix()),
+		Member: jobID,
+	}).Err()
+}
+
+// Heartbeat extends jobID's inflight lease by leaseTTL from now, so a
+// worker performing a slow delivery isn't reaped out from under it.
+func (s *Storage) Heartbeat(jobID string, leaseTTL time.Duration) error {
+	return s.MarkInflight(jobID, leaseTTL)
+}
+
+// ClearInflight removes jobID from the inflight tracking set, called once
+// its callback has reached a terminal state.
+func (s *Storage) ClearInflight(jobID string) error {
+	return s.Redis.ZRem(InflightQueue, jobID).Err()
+}
+
+// Reap atomically requeues every inflight job whose lease has expired and
+// is still marked InProgress, returning the IDs it reaped.
+func (s *Storage) Reap() ([]string, error) {
+	now := time.Now().Unix()
+
+	candidates, err := s.Redis.ZRangeByScore(InflightQueue, redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now, 10),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("reap: %v", err)
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, 2, 2+len(candidates))
+	keys[0] = InflightQueue
+	keys[1] = PendingCallbackQueue
+	args := make([]interface{}, 2, 2+len(candidates))
+	args[0] = float64(now)
+	args[1] = string(job.StateInProgress)
+	for _, id := range candidates {
+		keys = append(keys, JobKeyPrefix+id)
+		args = append(args, id)
+	}
+
+	res, err := s.Redis.Eval(reapScript, keys, args...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("reap: %v", err)
+	}
+
+	ids, ok := res.([]interface{})
+	if !ok {
+		return nil, nil
+	}
+	out := make([]string, 0, len(ids))
+	for _, id := range ids {
+		s, ok := id.(string)
+		if ok {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"gopkg.in/redis.v6"
+
+	"golang.skroutz.gr/skroutz/downloader/job"
+)
+
+func newTestStorage(t *testing.T) *Storage {
+	t.Helper()
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("could not start miniredis: %v", err)
+	}
+	t.Cleanup(mr.Close)
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	return New(client)
+}
+
+func TestReapRequeuesExpiredInProgressJobs(t *testing.T) {
+	s := newTestStorage(t)
+
+	j := &job.Job{ID: "job-1", CallbackState: job.StateInProgress}
+	if err := s.SaveJob(j); err != nil {
+		t.Fatalf("SaveJob: %v", err)
+	}
+	// lease already expired
+	if err := s.MarkInflight(j.ID, -time.Second); err != nil {
+		t.Fatalf("MarkInflight: %v", err)
+	}
+
+	ids, err := s.Reap()
+	if err != nil {
+		t.Fatalf("Reap: %v", err)
+	}
+	if len(ids) != 1 || ids[0] != j.ID {
+		t.Fatalf("Reap returned %v, want [%s]", ids, j.ID)
+	}
+
+	popped, err := s.PopCallback()
+	if err != nil {
+		t.Fatalf("PopCallback: %v", err)
+	}
+	if popped.ID != j.ID {
+		t.Fatalf("PopCallback returned %q, want %q", popped.ID, j.ID)
+	}
+}
+
+func TestReapSkipsJobsNoLongerInProgress(t *testing.T) {
+	s := newTestStorage(t)
+
+	j := &job.Job{ID: "job-2", CallbackState: job.StateFailed}
+	if err := s.SaveJob(j); err != nil {
+		t.Fatalf("SaveJob: %v", err)
+	}
+	if err := s.MarkInflight(j.ID, -time.Second); err != nil {
+		t.Fatalf("MarkInflight: %v", err)
+	}
+
+	ids, err := s.Reap()
+	if err != nil {
+		t.Fatalf("Reap: %v", err)
+	}
+	if len(ids) != 0 {
+		t.Fatalf("Reap requeued a non-InProgress job: %v", ids)
+	}
+
+	if _, err := s.PopCallback(); err != ErrEmptyQueue {
+		t.Fatalf("PopCallback error = %v, want ErrEmptyQueue", err)
+	}
+}
+
+func TestHeartbeatExtendsLeaseBeyondReap(t *testing.T) {
+	s := newTestStorage(t)
+
+	j := &job.Job{ID: "job-3", CallbackState: job.StateInProgress}
+	if err := s.SaveJob(j); err != nil {
+		t.Fatalf("SaveJob: %v", err)
+	}
+	if err := s.MarkInflight(j.ID, time.Second); err != nil {
+		t.Fatalf("MarkInflight: %v", err)
+	}
+	if err := s.Heartbeat(j.ID, time.Hour); err != nil {
+		t.Fatalf("Heartbeat: %v", err)
+	}
+
+	ids, err := s.Reap()
+	if err != nil {
+		t.Fatalf("Reap: %v", err)
+	}
+	if len(ids) != 0 {
+		t.Fatalf("Reap requeued a job whose lease was just extended: %v", ids)
+	}
+}
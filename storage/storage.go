@@ -0,0 +1,148 @@
+// Package storage provides the persistence layer of the downloader,
+// backed by Redis. It keeps track of jobs and the callback/download
+// queues that the processor and notifier consume.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"gopkg.in/redis.v6"
+
+	"golang.skroutz.gr/skroutz/downloader/job"
+)
+
+// JobKeyPrefix is the prefix used for the Redis hash that stores a Job.
+const JobKeyPrefix = "job:"
+
+// PendingCallbackQueue is the Redis ZSET holding jobs that are waiting for
+// their callback to be delivered, scored by the Unix timestamp of their
+// next attempt.
+const PendingCallbackQueue = "callbacks:pending"
+
+// ErrEmptyQueue is returned when there is no job available for popping.
+var ErrEmptyQueue = errors.New("queue is empty")
+
+// ErrRetryLater is returned when the queue has jobs, but none of them are
+// due for their next attempt yet.
+var ErrRetryLater = errors.New("no job is due for retry yet")
+
+// Storage is the component responsible for persisting jobs and managing
+// the queues that drive the processor and the notifier.
+type Storage struct {
+	Redis *redis.Client
+}
+
+// New returns a new Storage backed by the provided Redis client.
+func New(redisClient *redis.Client) *Storage {
+	return &Storage{Redis: redisClient}
+}
+
+// SaveJob persists j's state to Redis.
+func (s *Storage) SaveJob(j *job.Job) error {
+	return s.Redis.HMSet(JobKeyPrefix+j.ID, map[string]interface{}{
+		"AggrID":        j.AggrID,
+		"URL":           j.URL,
+		"CallbackURL":   j.CallbackURL,
+		"CallbackType":  j.CallbackType,
+		"ProgressURL":   j.ProgressURL,
+		"Extra":         j.Extra,
+		"DownloadState": string(j.DownloadState),
+		"DownloadMeta":  j.DownloadMeta,
+		"CallbackState": string(j.CallbackState),
+		"CallbackMeta":  j.CallbackMeta,
+		"CallbackCount": j.CallbackCount,
+	}).Err()
+}
+
+// GetJob fetches the job identified by id from Redis.
+func (s *Storage) GetJob(id string) (job.Job, error) {
+	res, err := s.Redis.HGetAll(JobKeyPrefix + id).Result()
+	if err != nil {
+		return job.Job{}, err
+	}
+	if len(res) == 0 {
+		return job.Job{}, fmt.Errorf("job %s not found", id)
+	}
+
+	callbackCount, err := strconv.Atoi(res["CallbackCount"])
+	if err != nil {
+		callbackCount = 0
+	}
+
+	return job.Job{
+		ID:            id,
+		AggrID:        res["AggrID"],
+		URL:           res["URL"],
+		CallbackURL:   res["CallbackURL"],
+		CallbackType:  res["CallbackType"],
+		ProgressURL:   res["ProgressURL"],
+		Extra:         res["Extra"],
+		DownloadState: job.State(res["DownloadState"]),
+		DownloadMeta:  res["DownloadMeta"],
+		CallbackState: job.State(res["CallbackState"]),
+		CallbackMeta:  res["CallbackMeta"],
+		CallbackCount: callbackCount,
+	}, nil
+}
+
+// RemoveJob deletes the job identified by id from Redis.
+func (s *Storage) RemoveJob(id string) error {
+	return s.Redis.Del(JobKeyPrefix + id).Err()
+}
+
+// QueuePendingCallback schedules j's callback for delivery. If j.NextAttemptAt
+// is zero, the callback is due immediately.
+func (s *Storage) QueuePendingCallback(j *job.Job) error {
+	at := j.NextAttemptAt
+	if at.IsZero() {
+		at = time.Now()
+	}
+	return s.Redis.ZAdd(PendingCallbackQueue, redis.Z{
+		Score:  float64(at.Unix()),
+		Member: j.ID,
+	}).Err()
+}
+
+// PopCallback returns the next job whose callback is due for delivery. It
+// returns ErrEmptyQueue if the queue is empty and ErrRetryLater if the
+// queue has jobs but none of them are due yet, or if another worker
+// removed the due job first.
+func (s *Storage) PopCallback() (job.Job, error) {
+	now := float64(time.Now().Unix())
+
+	members, err := s.Redis.ZRangeByScore(PendingCallbackQueue, redis.ZRangeBy{
+		Min:    "-inf",
+		Max:    fmt.Sprintf("%f", now),
+		Offset: 0,
+		Count:  1,
+	}).Result()
+	if err != nil {
+		return job.Job{}, err
+	}
+
+	if len(members) == 0 {
+		total, err := s.Redis.ZCard(PendingCallbackQueue).Result()
+		if err != nil {
+			return job.Job{}, err
+		}
+		if total == 0 {
+			return job.Job{}, ErrEmptyQueue
+		}
+		return job.Job{}, ErrRetryLater
+	}
+
+	id := members[0]
+	removed, err := s.Redis.ZRem(PendingCallbackQueue, id).Result()
+	if err != nil {
+		return job.Job{}, err
+	}
+	if removed == 0 {
+		// another worker popped it first
+		return job.Job{}, ErrRetryLater
+	}
+
+	return s.GetJob(id)
+}
@@ -0,0 +1,223 @@
+// Package xfer coalesces concurrent downloads of the same resource into a
+// single underlying fetch, modeled on Docker's distribution/xfer
+// TransferManager. It sits between storage and the download workers: jobs
+// that share a canonical URL attach to the same in-flight Transfer instead
+// of each triggering their own HTTP request.
+package xfer
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.skroutz.gr/skroutz/downloader/job"
+	"golang.skroutz.gr/skroutz/downloader/storage"
+)
+
+// Fetcher performs the actual download of a URL into dst, the path of the
+// job's storage slot. It is implemented by the processor. Implementations
+// must abort the download promptly once ctx is cancelled.
+type Fetcher interface {
+	Fetch(ctx context.Context, url, dst string) error
+}
+
+// Transfer represents a single in-flight download that one or more jobs
+// are waiting on.
+type Transfer struct {
+	key string
+	// dst is where the underlying fetch writes the resource. Every
+	// other subscriber's storage slot is hard-linked from here once
+	// the transfer completes successfully.
+	dst string
+
+	mu       sync.Mutex
+	watchers int
+	done     chan struct{}
+	err      error
+
+	cancel context.CancelFunc
+}
+
+// Watch returns a channel that is closed once the transfer has completed,
+// successfully or not, along with the resulting error, if any.
+func (t *Transfer) Watch() (<-chan struct{}, func() error) {
+	return t.done, func() error {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return t.err
+	}
+}
+
+// TransferManager coalesces Enqueue calls for identical canonical URLs into
+// a single Transfer, then fans out the result to every attached job.
+type TransferManager struct {
+	Storage *storage.Storage
+	Fetcher Fetcher
+
+	mu        sync.Mutex
+	transfers map[string]*Transfer
+}
+
+// NewTransferManager returns a TransferManager that uses fetcher to perform
+// the underlying downloads and s to persist job state and queue callbacks.
+func NewTransferManager(s *storage.Storage, fetcher Fetcher) *TransferManager {
+	return &TransferManager{
+		Storage:   s,
+		Fetcher:   fetcher,
+		transfers: make(map[string]*Transfer),
+	}
+}
+
+// Enqueue attaches j to the Transfer for j's canonical URL, starting a new
+// one if none is in flight. It returns once j has been counted as one of
+// the transfer's in-memory subscribers; the actual fetch and job completion
+// happen asynchronously.
+func (tm *TransferManager) Enqueue(j *job.Job, dst string) {
+	key := canonicalKey(j.URL, "")
+
+	tm.mu.Lock()
+	t, ok := tm.transfers[key]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		t = &Transfer{key: key, dst: dst, done: make(chan struct{}), watchers: 1, cancel: cancel}
+		tm.transfers[key] = t
+		tm.mu.Unlock()
+
+		go tm.run(ctx, t)
+	} else {
+		tm.mu.Unlock()
+
+		t.mu.Lock()
+		t.watchers++
+		t.mu.Unlock()
+	}
+
+	go tm.attach(t, j, dst)
+}
+
+// run performs the underlying fetch for t and fans out its result.
+func (tm *TransferManager) run(ctx context.Context, t *Transfer) {
+	t.err = tm.Fetcher.Fetch(ctx, t.key, t.dst)
+	close(t.done)
+
+	tm.mu.Lock()
+	delete(tm.transfers, t.key)
+	tm.mu.Unlock()
+}
+
+// attach waits for t to complete, hard-links the result into dst (j's own
+// storage slot, a no-op if it is the transfer's primary dst), then marks
+// j's DownloadState and queues its callback. The file is not copied: if the
+// link fails, j is marked failed.
+func (tm *TransferManager) attach(t *Transfer, j *job.Job, dst string) {
+	<-t.done
+
+	t.mu.Lock()
+	t.watchers--
+	t.mu.Unlock()
+
+	if t.err != nil {
+		j.DownloadState = job.StateFailed
+		j.DownloadMeta = t.err.Error()
+	} else if dst != t.dst {
+		if err := os.Link(t.dst, dst); err != nil {
+			j.DownloadState = job.StateFailed
+			j.DownloadMeta = err.Error()
+		} else {
+			j.DownloadState = job.StateSuccess
+		}
+	} else {
+		j.DownloadState = job.StateSuccess
+	}
+
+	if err := tm.Storage.SaveJob(j); err != nil {
+		return
+	}
+	tm.Storage.QueuePendingCallback(j)
+}
+
+// Cancel detaches j from its transfer. The underlying fetch is only
+// cancelled once its last subscriber has left.
+func (tm *TransferManager) Cancel(j *job.Job) {
+	key := canonicalKey(j.URL, "")
+
+	tm.mu.Lock()
+	t, ok := tm.transfers[key]
+	tm.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	t.watchers--
+	remaining := t.watchers
+	cancel := t.cancel
+	t.mu.Unlock()
+
+	if remaining <= 0 && cancel != nil {
+		cancel()
+	}
+}
+
+// canonicalURL normalizes raw so that equivalent requests for the same
+// resource coalesce onto the same Transfer: the scheme and host are
+// lower-cased, the scheme's default port is stripped, the path is cleaned
+// of "." and ".." segments and its trailing slash is dropped (except for
+// "/" itself), query parameters are re-encoded in sorted order, and any
+// fragment is discarded. Inputs that don't parse as a URL are returned
+// unchanged so identical malformed inputs still coalesce.
+func canonicalURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = stripDefaultPort(u.Scheme, strings.ToLower(u.Host))
+
+	if u.Path != "" {
+		u.Path = path.Clean(u.Path)
+		if u.Path != "/" {
+			u.Path = strings.TrimSuffix(u.Path, "/")
+		}
+	}
+
+	if u.RawQuery != "" {
+		u.RawQuery = u.Query().Encode()
+	}
+	u.Fragment = ""
+
+	return u.String()
+}
+
+// defaultPorts maps schemes to the port implied when none is given, so
+// "example.com" and "example.com:80" normalize to the same host.
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+func stripDefaultPort(scheme, host string) string {
+	port, ok := defaultPorts[scheme]
+	if !ok {
+		return host
+	}
+	if h, p, err := net.SplitHostPort(host); err == nil && p == port {
+		return h
+	}
+	return host
+}
+
+// canonicalKey combines a canonical URL with an optional content hash, so
+// that transfers coalesce on (normalized URL, content hash) once a caller
+// can supply one (e.g. a checksum published alongside the URL) rather than
+// URL alone, which can't tell two differently-hosted copies of the same
+// resource apart. Jobs without a known hash keep coalescing on URL alone.
+func canonicalKey(rawURL, contentHash string) string {
+	key := canonicalURL(rawURL)
+	if contentHash != "" {
+		key += "#" + contentHash
+	}
+	return key
+}
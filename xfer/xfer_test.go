@@ -0,0 +1,122 @@
+package xfer
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"gopkg.in/redis.v6"
+
+	"golang.skroutz.gr/skroutz/downloader/job"
+	"golang.skroutz.gr/skroutz/downloader/storage"
+)
+
+// blockingFetcher counts how many times Fetch is called and blocks until
+// release is closed, so tests can assert on coalescing before the
+// transfer completes.
+type blockingFetcher struct {
+	calls   int32
+	release chan struct{}
+}
+
+func (f *blockingFetcher) Fetch(ctx context.Context, url, dst string) error {
+	atomic.AddInt32(&f.calls, 1)
+	<-f.release
+	return nil
+}
+
+func newTestStorage(t *testing.T) *storage.Storage {
+	t.Helper()
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("could not start miniredis: %v", err)
+	}
+	t.Cleanup(mr.Close)
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	return storage.New(client)
+}
+
+func TestCanonicalURL(t *testing.T) {
+	cases := []struct {
+		name string
+		a, b string
+	}{
+		{"scheme and host casing", "HTTP://Example.com/f", "http://example.com/f"},
+		{"default http port", "http://example.com:80/f", "http://example.com/f"},
+		{"default https port", "https://example.com:443/f", "https://example.com/f"},
+		{"trailing slash", "http://example.com/f/", "http://example.com/f"},
+		{"root path trailing slash kept", "http://example.com/", "http://example.com/"},
+		{"dot segments", "http://example.com/a/../f", "http://example.com/f"},
+		{"query param order", "http://example.com/f?b=2&a=1", "http://example.com/f?a=1&b=2"},
+		{"fragment ignored", "http://example.com/f#frag", "http://example.com/f"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got, want := canonicalURL(c.a), canonicalURL(c.b); got != want {
+				t.Errorf("canonicalURL(%q) = %q, canonicalURL(%q) = %q, want equal", c.a, got, c.b, want)
+			}
+		})
+	}
+}
+
+func TestCanonicalURLDistinguishesDifferentResources(t *testing.T) {
+	a := canonicalURL("http://example.com/f")
+	b := canonicalURL("http://example.com/g")
+	if a == b {
+		t.Fatalf("canonicalURL collapsed distinct paths to %q", a)
+	}
+}
+
+func TestCanonicalKeyDistinguishesByContentHash(t *testing.T) {
+	url := "http://example.com/f"
+	if got := canonicalKey(url, ""); got != canonicalURL(url) {
+		t.Errorf("canonicalKey with no hash = %q, want %q", got, canonicalURL(url))
+	}
+
+	a := canonicalKey(url, "sha256:aaa")
+	b := canonicalKey(url, "sha256:bbb")
+	if a == b {
+		t.Fatalf("canonicalKey collapsed distinct content hashes to %q", a)
+	}
+}
+
+func TestEnqueueCoalescesIdenticalURLs(t *testing.T) {
+	s := newTestStorage(t)
+	fetcher := &blockingFetcher{release: make(chan struct{})}
+	tm := NewTransferManager(s, fetcher)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		j := &job.Job{ID: "job-" + string(rune('a'+i)), URL: "http://example.com/same-file"}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tm.Enqueue(j, "/tmp/doesnotmatter-"+j.ID)
+		}()
+	}
+	wg.Wait()
+
+	// give Enqueue's goroutines a moment to attach before releasing
+	time.Sleep(50 * time.Millisecond)
+	close(fetcher.release)
+
+	deadline := time.After(time.Second)
+	for atomic.LoadInt32(&fetcher.calls) == 0 {
+		select {
+		case <-deadline:
+			t.Fatal("fetcher was never called")
+		default:
+		}
+	}
+
+	if got := atomic.LoadInt32(&fetcher.calls); got != 1 {
+		t.Errorf("Fetch called %d times for 5 jobs sharing a URL, want 1", got)
+	}
+}